@@ -1,21 +1,44 @@
-/* 
+/*
 This Go program is using the Helm SDK to programmatically deploy the GitLab Runner Helm Chart to an AWS EKS Cluster.
 The Helm Chart values are read from a values.yaml file.
 The program should be optimised to be run in a GitLab CI pipeline.
-Before deploying the chart, we need to do configure a Kubernetes service account 'gitlab-runner' for the purposes of assumingan IAM role 'GitLabRunnerRole'. 
-To associate an IAM role with a Kubernetes service account, we can Use the aws cli method to create an IAM role and associate it with a Kubernetes service account.
+Before deploying the chart, we configure IAM Roles for Service Accounts (IRSA)
+for the 'gitlab-runner' Kubernetes service account so runner pods can assume
+the 'GitLabRunnerRole' IAM role directly, via the cluster's OIDC provider
+(see pkg/irsa) rather than a node-level instance profile.
+
+The bundled GitLabRunnerRolePolicyDocument grants broad EC2 and S3
+access (ec2:* and s3:*); pass --policy-preset to replace it with a
+least-privilege policy built from a sibling runner-policy.yaml by
+pkg/policy instead.
+
+After an install/upgrade, pkg/rollout waits for the runner Deployment to
+actually become ready (rather than returning as soon as the chart's
+objects are created), streaming Pod/Event updates to stdout. On a failed
+or timed-out rollout, --atomic rolls the release back (upgrade) or
+uninstalls it (install), mirroring `helm install/upgrade --atomic`. The
+process exits with a distinct non-zero code per failing phase (IAM, chart
+fetch/deploy, rollout) so .gitlab-ci.yml's `allow_failure:exit_codes:`
+can branch on it, and GitLab CI section markers group each phase's
+output in the job log.
+
+Usage: deploy install|upgrade|rollback|uninstall|status [--dry-run] [--atomic] [--policy-preset=minimal|docker-machine|kubernetes-executor]
 */
 
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"net/url"
 	"os"
-	"os/exec"
-	"strings"
+	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -23,8 +46,54 @@ import (
 	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	"github.com/danielhamelberg/helm-sdk-deploy-gitlab-runner-on-eks/pkg/chartsource"
+	helmmgr "github.com/danielhamelberg/helm-sdk-deploy-gitlab-runner-on-eks/pkg/helm"
+	"github.com/danielhamelberg/helm-sdk-deploy-gitlab-runner-on-eks/pkg/irsa"
+	"github.com/danielhamelberg/helm-sdk-deploy-gitlab-runner-on-eks/pkg/policy"
+	"github.com/danielhamelberg/helm-sdk-deploy-gitlab-runner-on-eks/pkg/rollout"
 )
 
+// Exit codes let .gitlab-ci.yml's `allow_failure:exit_codes:` branch on
+// which phase of the deploy failed, instead of treating every non-zero
+// exit the same way.
+const (
+	// exitIAMFailure covers AWS session/credentials, IRSA, and IAM role
+	// policy reconciliation failures.
+	exitIAMFailure = 10
+	// exitChartFetchFailure covers Helm repo/chart resolution and
+	// release install/upgrade/rollback/uninstall/status failures.
+	exitChartFetchFailure = 20
+	// exitRolloutFailure covers the post-install wait for the runner
+	// Deployment to actually become ready.
+	exitRolloutFailure = 30
+)
+
+// fail logs err and exits with code, the same way logrus.Fatal does but
+// with a phase-specific exit code for GitLab CI to branch on.
+func fail(code int, err error) {
+	logrus.Error(err)
+	os.Exit(code)
+}
+
+// sectionStart/sectionEnd emit GitLab CI's collapsible job log section
+// markers (https://docs.gitlab.com/ee/ci/jobs/job_logs/#custom-collapsible-sections)
+// around a phase of the deploy. They're inert, unrecognized text outside
+// a GitLab CI job, so they're safe to print unconditionally.
+func sectionStart(name string) {
+	fmt.Printf("section_start:%d:%s\r\033[0K%s\n", time.Now().Unix(), name, name)
+}
+
+func sectionEnd(name string) {
+	fmt.Printf("section_end:%d:%s\r\033[0K\n", time.Now().Unix(), name)
+}
+
+// maxPolicyVersions is the IAM-enforced limit on versions a customer managed
+// policy may retain at once.
+const maxPolicyVersions = 5
+
 const (
 	// GitLabRunnerRoleName is the name of the IAM role to be created
 	GitLabRunnerRoleName = "GitLabRunnerRole"
@@ -55,25 +124,8 @@ const (
 			}
 		]
 	}`
-	// GitLabRunnerRoleAssumeRolePolicyDocument is the policy document to be attached to the IAM role
-	GitLabRunnerRoleAssumeRolePolicyDocument = `{
-		"Version": "2012-10-17",
-		"Statement": [
-			{
-				"Effect": "Allow",
-				"Principal": {
-					"Service": "eks.amazonaws.com"
-				},
-				"Action": "sts:AssumeRole"
-			}
-		]
-	}`
 	// GitLabRunnerServiceAccountName is the name of the Kubernetes service account to be created
 	GitLabRunnerServiceAccountName = "gitlab-runner"
-	// GitLabRunnerServiceAccountAnnotation is the annotation to be attached to the Kubernetes service account
-	GitLabRunnerServiceAccountAnnotation = "eks.amazonaws.com/role-arn"
-	// GitLabRunnerServiceAccountAnnotationValue is the value of the annotation to be attached to the Kubernetes service account
-	GitLabRunnerServiceAccountAnnotationValue = "arn:aws:iam::%s:role/%s"
 	// GitLabRunnerHelmChartName is the name of the Helm chart to be deployed
 	GitLabRunnerHelmChartName = "gitlab-runner"
 	// GitLabRunnerHelmChartRepo is the repo of the Helm chart to be deployed
@@ -86,6 +138,17 @@ const (
 	GitLabRunnerHelmChartReleaseName = "gitlab-runner"
 	// GitLabRunnerHelmChartNamespace is the namespace of the Helm chart to be deployed
 	GitLabRunnerHelmChartNamespace = "gitlab-runner"
+	// GitLabRunnerHelmTimeout bounds every Helm SDK operation (install,
+	// upgrade, rollback, uninstall) so a wedged pipeline fails instead of
+	// hanging the CI job indefinitely.
+	GitLabRunnerHelmTimeout = 5 * time.Minute
+	// GitLabRunnerDeploymentName is the Kubernetes Deployment the chart
+	// creates for the runner manager pod, watched by pkg/rollout after
+	// install/upgrade.
+	GitLabRunnerDeploymentName = "gitlab-runner"
+	// GitLabRunnerRolloutTimeout bounds how long the post-install waiter
+	// gives the Deployment to report AvailableReplicas == Replicas.
+	GitLabRunnerRolloutTimeout = 5 * time.Minute
 )
 
 var (
@@ -93,60 +156,250 @@ var (
 	GitLabRunnerRoleARN string
 	// GitLabRunnerRolePolicyARN is the ARN of the IAM role policy to be created
 	GitLabRunnerRolePolicyARN string
-	// GitLabRunnerServiceAccountARN is the ARN of the Kubernetes service account to be created
-	GitLabRunnerServiceAccountARN string
 )
 
 func main() {
-	// Create a new AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String("eu-west-1")},
-	)
-	if err != nil {
-		logrus.Fatal(err)
+	args := os.Args[1:]
+	subcommand := "install"
+	if len(args) > 0 {
+		subcommand = args[0]
+		args = args[1:]
 	}
 
-	// Create a new IAM client
-	iamClient := iam.New(sess)
-
-	// Create a new STS client
-	stsClient := sts.New(sess)
-
-	// Get the account ID
-	accountID, err := getAccountID(stsClient)
-	if err != nil {
+	fs := flag.NewFlagSet("deploy", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the IAM/ServiceAccount reconcile diff without mutating anything")
+	policyPreset := fs.String("policy-preset", "", "build a least-privilege role policy from runner-policy.yaml instead of the bundled broad policy (minimal|docker-machine|kubernetes-executor)")
+	atomic := fs.Bool("atomic", false, "on a failed rollout, roll back (upgrade) or uninstall (install) the release, mirroring `helm install/upgrade --atomic`")
+	if err := fs.Parse(args); err != nil {
 		logrus.Fatal(err)
 	}
 
-	// Create the IAM role
-	GitLabRunnerRoleARN, err = createRole(iamClient, accountID)
+	// Create a new AWS session, optionally assuming a cross-account role
+	// with confused-deputy protection (see buildSession)
+	sess, err := buildSession()
 	if err != nil {
-		logrus.Fatal(err)
+		fail(exitIAMFailure, err)
 	}
 
-	// Create the IAM role policy
-	GitLabRunnerRolePolicyARN, err = createRolePolicy(iamClient, accountID)
+	// Build a Kubernetes clientset from the pipeline's kubeconfig
+	kubeClient, err := newKubeClient()
 	if err != nil {
-		logrus.Fatal(err)
+		fail(exitIAMFailure, err)
 	}
 
-	// Attach the IAM role policy to the IAM role
-	err = attachRolePolicy(iamClient, accountID)
-	if err != nil {
-		logrus.Fatal(err)
+	// IAM/IRSA setup only applies to install/upgrade: rollback, uninstall,
+	// and status never need to touch IAM/OIDC state, and requiring it would
+	// make a teardown job fail (or, worse, mutate IAM) for an unrelated
+	// reason when run with a minimal, Helm/K8s-only IAM policy.
+	if subcommand == "install" || subcommand == "upgrade" {
+		sectionStart("iam_setup")
+
+		// Create a new IAM client
+		iamClient := iam.New(sess)
+
+		// Create a new STS client
+		stsClient := sts.New(sess)
+
+		// Get the account ID
+		accountID, err := getAccountID(stsClient)
+		if err != nil {
+			fail(exitIAMFailure, err)
+		}
+
+		// Set up IRSA: discover the cluster's OIDC issuer, ensure an IAM OIDC
+		// provider exists for it, create/update GitLabRunnerRole with the
+		// correct federated trust policy, and create/annotate the
+		// ServiceAccount the runner pods will use.
+		GitLabRunnerRoleARN, err = irsa.Setup(sess, kubeClient, irsa.Config{
+			ClusterName:        clusterName(),
+			AccountID:          accountID,
+			RoleName:           GitLabRunnerRoleName,
+			Namespace:          GitLabRunnerHelmChartNamespace,
+			ServiceAccountName: GitLabRunnerServiceAccountName,
+			DryRun:             *dryRun,
+		})
+		if err != nil {
+			fail(exitIAMFailure, err)
+		}
+
+		// Resolve the desired role policy document: the bundled broad policy
+		// by default, or a least-privilege one built by pkg/policy when
+		// --policy-preset is set.
+		policyDoc, err := policyDocument(*policyPreset)
+		if err != nil {
+			fail(exitIAMFailure, err)
+		}
+
+		// Reconcile the IAM role policy (create it, or publish a new version
+		// only if the live document differs from the desired one)
+		GitLabRunnerRolePolicyARN, err = reconcilePolicy(iamClient, accountID, policyDoc, *dryRun)
+		if err != nil {
+			fail(exitIAMFailure, err)
+		}
+
+		// Attach the IAM role policy to the IAM role. AttachRolePolicy is itself
+		// idempotent, so no reconcile diffing is needed beyond honoring --dry-run.
+		err = attachRolePolicy(iamClient, *dryRun)
+		if err != nil {
+			fail(exitIAMFailure, err)
+		}
+
+		sectionEnd("iam_setup")
+	}
+
+	if *dryRun {
+		logrus.WithField("subcommand", subcommand).Info("dry-run: skipping helm release and rollout steps")
+		return
 	}
 
-	// Create the Kubernetes service account
-	GitLabRunnerServiceAccountARN, err = createServiceAccount(accountID)
+	sectionStart("chart_deploy")
+
+	// Drive the Helm release through the SDK instead of shelling out
+	hm, err := helmmgr.NewSDKManager(helmmgr.Config{
+		Namespace: GitLabRunnerHelmChartNamespace,
+		Timeout:   GitLabRunnerHelmTimeout,
+		Wait:      true,
+		Atomic:    *atomic,
+	})
 	if err != nil {
-		logrus.Fatal(err)
+		fail(exitChartFetchFailure, err)
+	}
+
+	if err := runSubcommand(hm, sess, subcommand); err != nil {
+		fail(exitChartFetchFailure, err)
+	}
+	sectionEnd("chart_deploy")
+
+	if subcommand != "install" && subcommand != "upgrade" {
+		return
+	}
+
+	sectionStart("rollout_wait")
+	rolloutCfg := rollout.Config{
+		Namespace:      GitLabRunnerHelmChartNamespace,
+		ReleaseName:    GitLabRunnerHelmChartReleaseName,
+		DeploymentName: GitLabRunnerDeploymentName,
+		Timeout:        GitLabRunnerRolloutTimeout,
+	}
+	if err := rollout.Wait(context.Background(), kubeClient, rolloutCfg); err != nil {
+		rollout.DumpDiagnostics(context.Background(), kubeClient, rolloutCfg)
+
+		if *atomic {
+			if subcommand == "upgrade" {
+				logrus.Warn("atomic rollout failed, rolling back release")
+				if rbErr := hm.Rollback(GitLabRunnerHelmChartReleaseName, 0); rbErr != nil {
+					logrus.WithError(rbErr).Error("failed to roll back release after failed rollout")
+				}
+			} else {
+				logrus.Warn("atomic rollout failed, uninstalling release")
+				if _, unErr := hm.Uninstall(GitLabRunnerHelmChartReleaseName); unErr != nil {
+					logrus.WithError(unErr).Error("failed to uninstall release after failed rollout")
+				}
+			}
+		}
+
+		fail(exitRolloutFailure, err)
+	}
+	sectionEnd("rollout_wait")
+}
+
+// chartConfig builds the chartsource.Config describing where to pull the
+// GitLab Runner chart from. It defaults to the bundled HTTPS repo, but can
+// be pointed at an OCI registry or a local path for air-gapped CI via
+// CHART_SOURCE/CHART_REF/CHART_VERSION.
+func chartConfig(sess *session.Session) chartsource.Config {
+	cfg := chartsource.Config{
+		Kind:       chartsource.Kind(os.Getenv("CHART_SOURCE")),
+		Ref:        "gitlab/" + GitLabRunnerHelmChartName,
+		Version:    GitLabRunnerHelmChartVersion,
+		Username:   os.Getenv("HELM_REGISTRY_USERNAME"),
+		Password:   os.Getenv("HELM_REGISTRY_PASSWORD"),
+		AWSSession: sess,
+	}
+
+	if ref := os.Getenv("CHART_REF"); ref != "" {
+		cfg.Ref = ref
+	}
+	if version := os.Getenv("CHART_VERSION"); version != "" {
+		cfg.Version = version
+	}
+
+	return cfg
+}
+
+// runSubcommand dispatches the CLI verb to the matching HelmManager method
+// so the binary can be invoked as `deploy install|upgrade|rollback|uninstall|status`
+// from a GitLab CI pipeline.
+func runSubcommand(hm helmmgr.Manager, sess *session.Session, subcommand string) error {
+	logrus.WithField("subcommand", subcommand).Info("running gitlab-runner deploy")
+
+	chart := chartConfig(sess)
+
+	var values map[string]interface{}
+	if subcommand == "install" || subcommand == "upgrade" {
+		vals, err := chartutil.ReadValuesFile(GitLabRunnerHelmChartValuesFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read values file %q", GitLabRunnerHelmChartValuesFile)
+		}
+		values = vals
 	}
 
-	// Deploy the Helm chart
-	err = deployHelmChart()
+	switch subcommand {
+	case "install":
+		if chart.Kind == "" || chart.Kind == chartsource.KindRepo {
+			if err := hm.AddRepo("gitlab", GitLabRunnerHelmChartRepo); err != nil {
+				return err
+			}
+		}
+		_, err := hm.Install(GitLabRunnerHelmChartReleaseName, chart, values)
+		return err
+	case "upgrade":
+		if chart.Kind == "" || chart.Kind == chartsource.KindRepo {
+			if err := hm.AddRepo("gitlab", GitLabRunnerHelmChartRepo); err != nil {
+				return err
+			}
+		}
+		_, err := hm.Upgrade(GitLabRunnerHelmChartReleaseName, chart, values)
+		return err
+	case "rollback":
+		return hm.Rollback(GitLabRunnerHelmChartReleaseName, 0)
+	case "uninstall":
+		_, err := hm.Uninstall(GitLabRunnerHelmChartReleaseName)
+		return err
+	case "status":
+		rel, err := hm.Status(GitLabRunnerHelmChartReleaseName)
+		if err != nil {
+			return err
+		}
+		logrus.WithField("status", rel.Info.Status).Info("release status")
+		return nil
+	default:
+		return errors.Errorf("unknown subcommand %q (want install|upgrade|rollback|uninstall|status)", subcommand)
+	}
+}
+
+// policyDocument resolves the IAM policy document reconcilePolicy should
+// converge GitLabRunnerRolePolicyName on. With preset empty (the
+// --policy-preset flag unset), it returns the bundled
+// GitLabRunnerRolePolicyDocument unchanged for backwards compatibility.
+// Otherwise it loads declarative inputs from RUNNER_POLICY_FILE (default
+// "runner-policy.yaml") and builds a least-privilege document scoped to
+// preset via pkg/policy.
+func policyDocument(preset string) (string, error) {
+	if preset == "" {
+		return GitLabRunnerRolePolicyDocument, nil
+	}
+
+	path := os.Getenv("RUNNER_POLICY_FILE")
+	if path == "" {
+		path = "runner-policy.yaml"
+	}
+
+	inputs, err := policy.LoadInputs(path, policy.Preset(preset))
 	if err != nil {
-		logrus.Fatal(err)
+		return "", err
 	}
+	return policy.Build(inputs)
 }
 
 func getAccountID(stsClient *sts.STS) (string, error) {
@@ -160,92 +413,232 @@ func getAccountID(stsClient *sts.STS) (string, error) {
 	return *getCallerIdentityOutput.Account, nil
 }
 
-func createRole(iamClient *iam.IAM, accountID string) (string, error) {
-	// Create the IAM role
-	createRoleOutput, err := iamClient.CreateRole(&iam.CreateRoleInput{
-		AssumeRolePolicyDocument: aws.String(GitLabRunnerRoleAssumeRolePolicyDocument),
-		RoleName:                 aws.String(GitLabRunnerRoleName),
-	})
+// clusterName returns the EKS cluster IRSA should be wired up against. It is
+// sourced from the CI pipeline's CLUSTER_NAME variable, falling back to a
+// sane default for local runs.
+func clusterName() string {
+	if name := os.Getenv("CLUSTER_NAME"); name != "" {
+		return name
+	}
+	return "gitlab-runner-eks"
+}
+
+// buildSession creates the base AWS session and, when ASSUME_ROLE_ARN is
+// set, layers an assumed-role credential provider on top of it so the
+// pipeline can run from a shared GitLab CI account into per-tenant AWS
+// accounts. When ASSUME_ROLE_SOURCE_ARN/ASSUME_ROLE_SOURCE_ACCOUNT are also
+// set, every AssumeRole call is stamped with the matching
+// x-amz-source-arn/x-amz-source-account headers so the trust role's policy
+// can condition on aws:SourceArn/aws:SourceAccount and close the
+// confused-deputy gap, the same protection cloud-provider-aws applies.
+func buildSession() (*session.Session, error) {
+	const region = "eu-west-1"
+
+	baseSess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create role")
+		return nil, errors.Wrap(err, "failed to create aws session")
+	}
+
+	roleARN := os.Getenv("ASSUME_ROLE_ARN")
+	if roleARN == "" {
+		return baseSess, nil
 	}
 
-	// Return the IAM role ARN
-	return *createRoleOutput.Role.Arn, nil
+	sourceARN := os.Getenv("ASSUME_ROLE_SOURCE_ARN")
+	sourceAccount := os.Getenv("ASSUME_ROLE_SOURCE_ACCOUNT")
+	externalID := os.Getenv("ASSUME_ROLE_EXTERNAL_ID")
+
+	stsClient := sts.New(baseSess)
+	stsClient.Handlers.Sign.PushFront(confusedDeputyHandler(sourceARN, sourceAccount))
+
+	creds := stscreds.NewCredentialsWithClient(stsClient, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+	})
+
+	return session.NewSession(&aws.Config{Region: aws.String(region), Credentials: creds})
 }
 
-func createRolePolicy(iamClient *iam.IAM, accountID string) (string, error) {
-	// Create the IAM role policy
-	createPolicyOutput, err := iamClient.CreatePolicy(&iam.CreatePolicyInput{
-		Description: aws.String("GitLab Runner role policy"),
-		PolicyDocument: aws.String(GitLabRunnerRolePolicyDocument),
-		PolicyName: aws.String(GitLabRunnerRolePolicyName),
+// confusedDeputyHandler stamps outgoing sts:AssumeRole requests with
+// x-amz-source-arn/x-amz-source-account so the target role's trust policy
+// can require them via aws:SourceArn/aws:SourceAccount conditions.
+func confusedDeputyHandler(sourceARN, sourceAccount string) func(*request.Request) {
+	return func(r *request.Request) {
+		if r.Operation == nil || r.Operation.Name != "AssumeRole" {
+			return
+		}
+		if sourceARN != "" {
+			r.HTTPRequest.Header.Set("X-Amz-Source-Arn", sourceARN)
+		}
+		if sourceAccount != "" {
+			r.HTTPRequest.Header.Set("X-Amz-Source-Account", sourceAccount)
+		}
+	}
+}
+
+// reconcilePolicy creates GitLabRunnerRolePolicyName if it doesn't exist, or
+// publishes a new default version of it only when the live document differs
+// from document, pruning old non-default versions so the
+// 5-version-per-policy IAM limit is never hit. Re-running the pipeline
+// against an up-to-date policy is then a no-op. When dryRun is set, the
+// policy is only ever read (via GetPolicy), never created or published.
+func reconcilePolicy(iamClient *iam.IAM, accountID, document string, dryRun bool) (string, error) {
+	policyARN := fmt.Sprintf("arn:aws:iam::%s:policy/%s", accountID, GitLabRunnerRolePolicyName)
+
+	if dryRun {
+		getOut, err := iamClient.GetPolicy(&iam.GetPolicyInput{PolicyArn: aws.String(policyARN)})
+		if err != nil {
+			awsErr, ok := err.(interface{ Code() string })
+			if !ok || awsErr.Code() != iam.ErrCodeNoSuchEntityException {
+				return "", errors.Wrap(err, "failed to get existing role policy")
+			}
+			logrus.Info("dry-run: would create role policy")
+			return policyARN, nil
+		}
+
+		versionOut, err := iamClient.GetPolicyVersion(&iam.GetPolicyVersionInput{
+			PolicyArn: aws.String(policyARN),
+			VersionId: getOut.Policy.DefaultVersionId,
+		})
+		if err != nil {
+			return "", errors.Wrap(err, "failed to get default role policy version")
+		}
+
+		live, err := url.QueryUnescape(aws.StringValue(versionOut.PolicyVersion.Document))
+		if err != nil {
+			return "", errors.Wrap(err, "failed to decode live role policy document")
+		}
+
+		if live == document {
+			logrus.Debug("role policy already up to date")
+			return policyARN, nil
+		}
+
+		logrus.Infof("dry-run: would publish new role policy version\n--- live\n%s\n--- desired\n%s", live, document)
+		return policyARN, nil
+	}
+
+	createOut, err := iamClient.CreatePolicy(&iam.CreatePolicyInput{
+		Description:    aws.String("GitLab Runner role policy"),
+		PolicyDocument: aws.String(document),
+		PolicyName:     aws.String(GitLabRunnerRolePolicyName),
 	})
-	if err != nil {
+	if err == nil {
+		return *createOut.Policy.Arn, nil
+	}
+
+	awsErr, ok := err.(interface{ Code() string })
+	if !ok || awsErr.Code() != iam.ErrCodeEntityAlreadyExistsException {
 		return "", errors.Wrap(err, "failed to create role policy")
 	}
 
-	// Return the IAM role policy ARN
-	return *createPolicyOutput.Policy.Arn, nil
-}
+	getOut, err := iamClient.GetPolicy(&iam.GetPolicyInput{PolicyArn: aws.String(policyARN)})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get existing role policy")
+	}
 
-func attachRolePolicy(iamClient *iam.IAM, accountID string) error {
-	// Attach the IAM role policy to the IAM role
-	_, err := iamClient.AttachRolePolicy(&iam.AttachRolePolicyInput{
-		PolicyArn: aws.String(GitLabRunnerRolePolicyARN),
-		RoleName: aws.String(GitLabRunnerRoleName),
+	versionOut, err := iamClient.GetPolicyVersion(&iam.GetPolicyVersionInput{
+		PolicyArn: aws.String(policyARN),
+		VersionId: getOut.Policy.DefaultVersionId,
 	})
 	if err != nil {
-		return errors.Wrap(err, "failed to attach role policy")
+		return "", errors.Wrap(err, "failed to get default role policy version")
 	}
 
-	return nil
+	live, err := url.QueryUnescape(aws.StringValue(versionOut.PolicyVersion.Document))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode live role policy document")
+	}
+
+	if live == document {
+		logrus.Debug("role policy already up to date")
+		return policyARN, nil
+	}
+
+	// Make room first: IAM rejects CreatePolicyVersion once a policy
+	// already holds maxPolicyVersions versions.
+	if err := pruneOldPolicyVersions(iamClient, policyARN); err != nil {
+		return "", err
+	}
+
+	if _, err := iamClient.CreatePolicyVersion(&iam.CreatePolicyVersionInput{
+		PolicyArn:      aws.String(policyARN),
+		PolicyDocument: aws.String(document),
+		SetAsDefault:   aws.Bool(true),
+	}); err != nil {
+		return "", errors.Wrap(err, "failed to publish new role policy version")
+	}
+
+	logrus.Info("published new role policy version")
+	return policyARN, nil
 }
 
-func createServiceAccount(accountID string) (string, error) {
-	// Create the Kubernetes service account
-	cmd := exec.Command("kubectl", "create", "serviceaccount", GitLabRunnerServiceAccountName)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+// pruneOldPolicyVersions deletes the oldest non-default versions of
+// policyARN so that one more version can be created without the version
+// count exceeding IAM's maxPolicyVersions limit.
+func pruneOldPolicyVersions(iamClient *iam.IAM, policyARN string) error {
+	listOut, err := iamClient.ListPolicyVersions(&iam.ListPolicyVersionsInput{PolicyArn: aws.String(policyARN)})
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create service account")
+		return errors.Wrap(err, "failed to list role policy versions")
+	}
+
+	var nonDefault []*iam.PolicyVersion
+	for _, v := range listOut.Versions {
+		if !aws.BoolValue(v.IsDefaultVersion) {
+			nonDefault = append(nonDefault, v)
+		}
+	}
+	sort.Slice(nonDefault, func(i, j int) bool {
+		return nonDefault[i].CreateDate.Before(*nonDefault[j].CreateDate)
+	})
+
+	excess := len(listOut.Versions) + 1 - maxPolicyVersions
+	for i := 0; i < excess && i < len(nonDefault); i++ {
+		if _, err := iamClient.DeletePolicyVersion(&iam.DeletePolicyVersionInput{
+			PolicyArn: aws.String(policyARN),
+			VersionId: nonDefault[i].VersionId,
+		}); err != nil {
+			return errors.Wrapf(err, "failed to prune policy version %s", aws.StringValue(nonDefault[i].VersionId))
+		}
 	}
+	return nil
+}
 
-	// Get the Kubernetes service account ARN
-	GitLabRunnerServiceAccountARN = fmt.Sprintf(GitLabRunnerServiceAccountAnnotationValue, accountID, GitLabRunnerRoleName)
+// attachRolePolicy attaches GitLabRunnerRolePolicyARN to GitLabRunnerRoleName.
+// AttachRolePolicy is already idempotent on AWS's side (re-attaching an
+// already-attached policy is a no-op), so the only reconcile concern here is
+// honoring --dry-run.
+func attachRolePolicy(iamClient *iam.IAM, dryRun bool) error {
+	if dryRun {
+		logrus.Infof("dry-run: would ensure policy %s is attached to role %s", GitLabRunnerRolePolicyARN, GitLabRunnerRoleName)
+		return nil
+	}
 
-	// Annotate the Kubernetes service account
-	cmd = exec.Command("kubectl", "annotate", "serviceaccount", GitLabRunnerServiceAccountName, GitLabRunnerServiceAccountAnnotation+"="+GitLabRunnerServiceAccountARN)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	_, err := iamClient.AttachRolePolicy(&iam.AttachRolePolicyInput{
+		PolicyArn: aws.String(GitLabRunnerRolePolicyARN),
+		RoleName:  aws.String(GitLabRunnerRoleName),
+	})
 	if err != nil {
-		return "", errors.Wrap(err, "failed to annotate service account")
+		return errors.Wrap(err, "failed to attach role policy")
 	}
 
-	// Return the Kubernetes service account ARN
-	return GitLabRunnerServiceAccountARN, nil
+	return nil
 }
 
-func deployHelmChart() error {
-	// Add the Helm chart repo
-	cmd := exec.Command("helm", "repo", "add", "gitlab", GitLabRunnerHelmChartRepo)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+// newKubeClient builds a Kubernetes clientset the same way kubectl would:
+// from the KUBECONFIG pointed at by the pipeline, or the in-cluster config
+// when running as a pod.
+func newKubeClient() (kubernetes.Interface, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
 	if err != nil {
-		return errors.Wrap(err, "failed to add helm chart repo")
+		return nil, errors.Wrap(err, "failed to load kubeconfig")
 	}
 
-	// Install the Helm chart
-	cmd = exec.Command("helm", "install", "--name", GitLabRunnerHelmChartReleaseName, "--namespace", GitLabRunnerHelmChartNamespace, "--values", GitLabRunnerHelmChartValuesFile, GitLabRunnerHelmChartName, "--version", GitLabRunnerHelmChartVersion)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return errors.Wrap(err, "failed to install helm chart")
+		return nil, errors.Wrap(err, "failed to build kubernetes clientset")
 	}
-
-	return nil
+	return clientset, nil
 }
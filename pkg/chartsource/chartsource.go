@@ -0,0 +1,209 @@
+// Package chartsource abstracts over where the GitLab Runner chart is
+// pulled from, so the deploy binary isn't hardcoded to a single HTTPS
+// chart repo. A ChartLocator resolves a chart reference to a loaded
+// *chart.Chart regardless of whether it lives in a classic HTTP repo, an
+// OCI registry, or a local directory/archive (for air-gapped CI).
+package chartsource
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+// Kind selects which backend a Config resolves a chart through.
+type Kind string
+
+const (
+	// KindRepo resolves Ref as a "<repo>/<chart>" reference (e.g.
+	// "gitlab/gitlab-runner") against a classic HTTPS Helm repo already
+	// registered with `helm repo add` (see pkg/helm.AddRepo).
+	KindRepo Kind = "repo"
+	// KindOCI resolves Ref as an "oci://" reference against an OCI
+	// registry (ECR, GHCR, Harbor, ...).
+	KindOCI Kind = "oci"
+	// KindPath resolves Ref as a local filesystem path to a chart
+	// directory or packaged .tgz archive, for air-gapped CI runners.
+	KindPath Kind = "path"
+)
+
+// Config describes where to pull the chart from and how to authenticate.
+// The deploy binary fills it from the CHART_SOURCE, CHART_REF and
+// CHART_VERSION environment variables; it is not read from values.yaml.
+type Config struct {
+	Kind    Kind
+	Ref     string
+	Version string
+
+	// Username/Password, when Username is set, log in to the OCI registry
+	// for KindOCI (unless the ECR login below applies). They are not used
+	// for KindRepo or KindPath.
+	Username string
+	Password string
+
+	// AWSSession, when set and Ref points at an ECR registry
+	// (*.dkr.ecr.*.amazonaws.com), is used to log in to it automatically
+	// via ECRLogin instead of requiring Username/Password.
+	AWSSession *session.Session
+}
+
+// NewLocator builds the ChartLocator matching cfg.Kind.
+func NewLocator(cfg Config, settings *cli.EnvSettings) (ChartLocator, error) {
+	switch cfg.Kind {
+	case "", KindRepo:
+		return &repoLocator{ref: cfg.Ref, version: cfg.Version}, nil
+	case KindOCI:
+		regClient, err := registry.NewClient()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to construct OCI registry client")
+		}
+
+		host := ociHost(cfg.Ref)
+		switch {
+		case cfg.AWSSession != nil && isECRHost(host):
+			if err := ECRLogin(cfg.AWSSession, regClient, host); err != nil {
+				return nil, err
+			}
+		case cfg.Username != "":
+			if err := regClient.Login(host, registry.LoginOptBasicAuth(cfg.Username, cfg.Password)); err != nil {
+				return nil, errors.Wrapf(err, "failed to log in to OCI registry %q", host)
+			}
+		}
+
+		return &ociLocator{ref: cfg.Ref, version: cfg.Version, regClient: regClient}, nil
+	case KindPath:
+		return &pathLocator{path: cfg.Ref}, nil
+	default:
+		return nil, errors.Errorf("unknown chart source kind %q (want repo|oci|path)", cfg.Kind)
+	}
+}
+
+// ociHost extracts the registry host from an "oci://host/path" reference.
+func ociHost(ref string) string {
+	host := strings.TrimPrefix(ref, "oci://")
+	if i := strings.Index(host, "/"); i != -1 {
+		host = host[:i]
+	}
+	return host
+}
+
+// isECRHost reports whether host looks like a private ECR registry, e.g.
+// "123456789012.dkr.ecr.eu-west-1.amazonaws.com".
+func isECRHost(host string) bool {
+	return strings.Contains(host, ".dkr.ecr.") && strings.HasSuffix(host, ".amazonaws.com")
+}
+
+// ChartLocator resolves a configured chart reference to a loaded chart.
+type ChartLocator interface {
+	Locate(settings *cli.EnvSettings) (*chart.Chart, error)
+}
+
+// repoLocator resolves ref (a "<repo>/<chart>" reference, e.g.
+// "gitlab/gitlab-runner") against a classic HTTPS repo already known to
+// settings' repository.yaml.
+type repoLocator struct {
+	ref     string
+	version string
+}
+
+func (l *repoLocator) Locate(settings *cli.EnvSettings) (*chart.Chart, error) {
+	opts := action.ChartPathOptions{Version: l.version}
+	path, err := opts.LocateChart(l.ref, settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to locate repo chart %q", l.ref)
+	}
+	return loadChart(path)
+}
+
+// ociLocator resolves ref (an "oci://" reference) against an OCI registry.
+type ociLocator struct {
+	ref       string
+	version   string
+	regClient *registry.Client
+}
+
+func (l *ociLocator) Locate(settings *cli.EnvSettings) (*chart.Chart, error) {
+	if !strings.HasPrefix(l.ref, "oci://") {
+		return nil, errors.Errorf("OCI chart ref %q must start with oci://", l.ref)
+	}
+
+	// action.ChartPathOptions' registry client field is unexported; Install
+	// (and Upgrade) expose it via SetRegistryClient, so a throwaway Install
+	// is the supported way to resolve an "oci://" chart path outside of
+	// actually running an install.
+	install := action.NewInstall(new(action.Configuration))
+	install.Version = l.version
+	install.SetRegistryClient(l.regClient)
+
+	path, err := install.LocateChart(l.ref, settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to locate OCI chart %q", l.ref)
+	}
+	return loadChart(path)
+}
+
+// pathLocator loads a chart directory or .tgz archive straight off disk,
+// for CI runners with no network access to any chart source.
+type pathLocator struct {
+	path string
+}
+
+func (l *pathLocator) Locate(_ *cli.EnvSettings) (*chart.Chart, error) {
+	return loadChart(l.path)
+}
+
+func loadChart(path string) (*chart.Chart, error) {
+	chrt, err := loader.Load(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load chart %q", path)
+	}
+	return chrt, nil
+}
+
+// ECRLogin authenticates regClient against an ECR registry using the
+// caller's AWS credentials, equivalent to
+// `aws ecr get-login-password | helm registry login --username AWS --password-stdin`,
+// so GitLab Runner charts mirrored to a private ECR can be pulled in
+// locked-down environments without an `aws` CLI binary on PATH.
+func ECRLogin(sess *session.Session, regClient *registry.Client, registryHost string) error {
+	ecrClient := ecr.New(sess)
+
+	out, err := ecrClient.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return errors.Wrap(err, "failed to get ECR authorization token")
+	}
+	if len(out.AuthorizationData) == 0 {
+		return errors.New("ECR returned no authorization data")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return errors.Wrap(err, "failed to decode ECR authorization token")
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return errors.New("malformed ECR authorization token")
+	}
+	username, password := parts[0], parts[1]
+
+	if err := regClient.Login(registryHost,
+		registry.LoginOptBasicAuth(username, password),
+		registry.LoginOptInsecure(false),
+	); err != nil {
+		return errors.Wrapf(err, "failed to log in to ECR registry %q", registryHost)
+	}
+
+	logrus.WithField("registry", registryHost).Info("logged in to ECR")
+	return nil
+}
@@ -0,0 +1,227 @@
+// Package helm wraps the Helm Go SDK (helm.sh/helm/v3/pkg/action) so the
+// deploy binary can manage the GitLab Runner release in-process, without
+// shelling out to the helm CLI binary.
+package helm
+
+import (
+	stderrors "errors"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/action"
+	helmchart "helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage/driver"
+
+	"github.com/danielhamelberg/helm-sdk-deploy-gitlab-runner-on-eks/pkg/chartsource"
+)
+
+// Manager is the subset of Helm release operations the GitLab CI pipeline
+// needs to drive from Go. It is implemented by SDKManager; tests/callers can
+// substitute a fake.
+type Manager interface {
+	AddRepo(name, url string) error
+	Install(releaseName string, chart chartsource.Config, values map[string]interface{}) (*release.Release, error)
+	Upgrade(releaseName string, chart chartsource.Config, values map[string]interface{}) (*release.Release, error)
+	Rollback(releaseName string, toVersion int) error
+	Uninstall(releaseName string) (*release.UninstallReleaseResponse, error)
+	Status(releaseName string) (*release.Release, error)
+}
+
+// Config controls how an SDKManager resolves the target cluster/namespace
+// and how long it waits for release operations to finish.
+type Config struct {
+	// Namespace is the release namespace passed to action.Configuration.
+	Namespace string
+	// Timeout bounds every install/upgrade/rollback/uninstall call. Zero
+	// means DefaultTimeout.
+	Timeout time.Duration
+	// Wait mirrors `helm install --wait`: block until the release's
+	// resources are in a ready state before returning.
+	Wait bool
+	// Atomic mirrors `helm install/upgrade --atomic`: on a failed install,
+	// uninstall it; on a failed upgrade, roll it back.
+	Atomic bool
+}
+
+// DefaultTimeout is used when Config.Timeout is zero.
+const DefaultTimeout = 5 * time.Minute
+
+// SDKManager is the default Manager, backed by the in-process Helm SDK
+// action.Configuration instead of the helm CLI binary. This removes the
+// hard dependency on `helm`/`kubectl` being present in the CI image.
+type SDKManager struct {
+	cfg      *action.Configuration
+	settings *cli.EnvSettings
+	timeout  time.Duration
+	wait     bool
+	atomic   bool
+}
+
+// NewSDKManager builds a Manager bound to the given namespace. It reuses the
+// kubeconfig/REST config resolution that cli.New() derives from the
+// environment (KUBECONFIG, in-cluster config, etc.), so no separate
+// context-handling code is required here.
+func NewSDKManager(c Config) (*SDKManager, error) {
+	settings := cli.New()
+	settings.SetNamespace(c.Namespace)
+
+	cfg := new(action.Configuration)
+	if err := cfg.Init(settings.RESTClientGetter(), c.Namespace, os.Getenv("HELM_DRIVER"), debugLog); err != nil {
+		return nil, errors.Wrap(err, "failed to initialize helm action configuration")
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &SDKManager{cfg: cfg, settings: settings, timeout: timeout, wait: c.Wait, atomic: c.Atomic}, nil
+}
+
+func debugLog(format string, v ...interface{}) {
+	logrus.Debugf(format, v...)
+}
+
+// AddRepo registers a chart repository the way `helm repo add` would,
+// writing/merging the entry into the settings' repository.yaml so that a
+// "<name>/<chart>" reference (e.g. "gitlab/gitlab-runner") can later be
+// resolved against it.
+func (m *SDKManager) AddRepo(name, url string) error {
+	rf, err := repo.LoadFile(m.settings.RepositoryConfig)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "failed to load helm repository file")
+	}
+	if rf == nil {
+		rf = repo.NewFile()
+	}
+
+	if rf.Has(name) && rf.Get(name).URL == url {
+		logrus.WithField("repo", name).Debug("helm repo already registered with the same URL")
+		return nil
+	}
+
+	entry := &repo.Entry{Name: name, URL: url}
+	chartRepo, err := repo.NewChartRepository(entry, getter.All(m.settings))
+	if err != nil {
+		return errors.Wrapf(err, "failed to construct chart repository %q", name)
+	}
+	chartRepo.CachePath = m.settings.RepositoryCache
+
+	if _, err := chartRepo.DownloadIndexFile(); err != nil {
+		return errors.Wrapf(err, "failed to download index for repo %q (%s)", name, url)
+	}
+
+	rf.Update(entry)
+	if err := rf.WriteFile(m.settings.RepositoryConfig, 0o644); err != nil {
+		return errors.Wrap(err, "failed to persist helm repository file")
+	}
+
+	logrus.WithFields(logrus.Fields{"repo": name, "url": url}).Info("helm repo added")
+	return nil
+}
+
+// Install performs `helm install` (with --wait/--atomic as set in Config) for chart, regardless of
+// whether it's backed by an HTTPS repo, an OCI registry, or a local path.
+func (m *SDKManager) Install(releaseName string, chart chartsource.Config, values map[string]interface{}) (*release.Release, error) {
+	chrt, err := m.locateChart(chart)
+	if err != nil {
+		return nil, err
+	}
+
+	install := action.NewInstall(m.cfg)
+	install.ReleaseName = releaseName
+	install.Namespace = m.settings.Namespace()
+	install.CreateNamespace = true
+	install.Timeout = m.timeout
+	install.Wait = m.wait
+	install.Atomic = m.atomic
+
+	rel, err := install.Run(chrt, values)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to install release %q", releaseName)
+	}
+	return rel, nil
+}
+
+// Upgrade performs upgrade-or-install semantics like eksctl/Constellation's
+// helm clients: if the release does not exist yet it falls back to Install
+// instead of failing.
+func (m *SDKManager) Upgrade(releaseName string, chart chartsource.Config, values map[string]interface{}) (*release.Release, error) {
+	hist := action.NewHistory(m.cfg)
+	hist.Max = 1
+	if _, err := hist.Run(releaseName); err != nil {
+		if !stderrors.Is(err, driver.ErrReleaseNotFound) {
+			return nil, errors.Wrapf(err, "failed to look up history for release %q", releaseName)
+		}
+		logrus.WithField("release", releaseName).Info("release not found, installing instead of upgrading")
+		return m.Install(releaseName, chart, values)
+	}
+
+	chrt, err := m.locateChart(chart)
+	if err != nil {
+		return nil, err
+	}
+
+	upgrade := action.NewUpgrade(m.cfg)
+	upgrade.Namespace = m.settings.Namespace()
+	upgrade.Timeout = m.timeout
+	upgrade.Wait = m.wait
+	upgrade.Atomic = m.atomic // roll back automatically on a failed upgrade, gated on --atomic
+
+	rel, err := upgrade.Run(releaseName, chrt, values)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to upgrade release %q", releaseName)
+	}
+	return rel, nil
+}
+
+// Rollback reverts releaseName to toVersion (0 means the previous release).
+func (m *SDKManager) Rollback(releaseName string, toVersion int) error {
+	rollback := action.NewRollback(m.cfg)
+	rollback.Version = toVersion
+	rollback.Timeout = m.timeout
+	rollback.Wait = m.wait
+
+	if err := rollback.Run(releaseName); err != nil {
+		return errors.Wrapf(err, "failed to roll back release %q", releaseName)
+	}
+	return nil
+}
+
+// Uninstall removes releaseName and its Kubernetes resources.
+func (m *SDKManager) Uninstall(releaseName string) (*release.UninstallReleaseResponse, error) {
+	uninstall := action.NewUninstall(m.cfg)
+	uninstall.Timeout = m.timeout
+
+	resp, err := uninstall.Run(releaseName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to uninstall release %q", releaseName)
+	}
+	return resp, nil
+}
+
+// Status returns the current release state, equivalent to `helm status`.
+func (m *SDKManager) Status(releaseName string) (*release.Release, error) {
+	status := action.NewStatus(m.cfg)
+	rel, err := status.Run(releaseName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get status for release %q", releaseName)
+	}
+	return rel, nil
+}
+
+// locateChart resolves chart to a loaded chart via the matching
+// chartsource.ChartLocator (repo, OCI, or local path).
+func (m *SDKManager) locateChart(chart chartsource.Config) (*helmchart.Chart, error) {
+	locator, err := chartsource.NewLocator(chart, m.settings)
+	if err != nil {
+		return nil, err
+	}
+	return locator.Locate(m.settings)
+}
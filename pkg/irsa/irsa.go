@@ -0,0 +1,331 @@
+// Package irsa wires up IAM Roles for Service Accounts (IRSA) for the
+// GitLab Runner pod identity: discovering the cluster's OIDC issuer,
+// ensuring an IAM OIDC provider exists for it, building the federated
+// trust policy that lets a Kubernetes ServiceAccount assume an IAM role via
+// sts:AssumeRoleWithWebIdentity, and creating/annotating that ServiceAccount.
+//
+// The previous trust policy in main.go trusted the "eks.amazonaws.com"
+// service principal, which only works for cluster-level control plane
+// roles, not for pods assuming a role through IRSA.
+package irsa
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec // SHA-1 is the documented OIDC provider thumbprint algorithm
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// STSAudience is the fixed audience IRSA uses for AssumeRoleWithWebIdentity.
+const STSAudience = "sts.amazonaws.com"
+
+// ServiceAccountAnnotation is the annotation EKS's pod identity webhook
+// looks for on a ServiceAccount to inject the role ARN and token.
+const ServiceAccountAnnotation = "eks.amazonaws.com/role-arn"
+
+// Config describes the cluster, role, and ServiceAccount that IRSA should
+// be wired up for.
+type Config struct {
+	ClusterName        string
+	AccountID          string
+	RoleName           string
+	Namespace          string
+	ServiceAccountName string
+	// DryRun logs the reconcile diff for the role's trust policy and the
+	// ServiceAccount annotation without mutating either.
+	DryRun bool
+}
+
+// Setup discovers the cluster's OIDC issuer, ensures an IAM OIDC provider
+// exists for it, creates/updates RoleName with the correct federated trust
+// policy, and creates/annotates the target ServiceAccount. It returns the
+// role ARN the ServiceAccount was annotated with.
+func Setup(sess *session.Session, kubeClient kubernetes.Interface, cfg Config) (string, error) {
+	eksClient := eks.New(sess)
+	iamClient := iam.New(sess)
+
+	issuer, err := clusterOIDCIssuer(eksClient, cfg.ClusterName)
+	if err != nil {
+		return "", err
+	}
+
+	providerARN, err := ensureOIDCProvider(iamClient, cfg.AccountID, issuer, cfg.DryRun)
+	if err != nil {
+		return "", err
+	}
+
+	trustPolicy, err := trustPolicyDocument(providerARN, issuer, cfg.Namespace, cfg.ServiceAccountName)
+	if err != nil {
+		return "", err
+	}
+
+	roleARN, err := createOrUpdateRole(iamClient, cfg.AccountID, cfg.RoleName, trustPolicy, cfg.DryRun)
+	if err != nil {
+		return "", err
+	}
+
+	if err := ensureServiceAccount(kubeClient, cfg.Namespace, cfg.ServiceAccountName, roleARN, cfg.DryRun); err != nil {
+		return "", err
+	}
+
+	return roleARN, nil
+}
+
+// clusterOIDCIssuer calls eks:DescribeCluster and returns Identity.Oidc.Issuer,
+// e.g. "https://oidc.eks.eu-west-1.amazonaws.com/id/EXAMPLED539D4633E53DE1B716D3041E".
+func clusterOIDCIssuer(eksClient *eks.EKS, clusterName string) (string, error) {
+	out, err := eksClient.DescribeCluster(&eks.DescribeClusterInput{Name: aws.String(clusterName)})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to describe cluster %q", clusterName)
+	}
+	if out.Cluster == nil || out.Cluster.Identity == nil || out.Cluster.Identity.Oidc == nil || out.Cluster.Identity.Oidc.Issuer == nil {
+		return "", errors.Errorf("cluster %q has no OIDC issuer; is IRSA enabled?", clusterName)
+	}
+	return *out.Cluster.Identity.Oidc.Issuer, nil
+}
+
+// ensureOIDCProvider returns the ARN of the IAM OIDC provider for issuer,
+// creating it (with the correct root CA thumbprint) if it does not already
+// exist. This mirrors what `eksctl utils associate-iam-oidc-provider` does.
+// When dryRun is set, a needed create is logged but never applied.
+func ensureOIDCProvider(iamClient *iam.IAM, accountID, issuer string, dryRun bool) (string, error) {
+	host := strings.TrimPrefix(issuer, "https://")
+	arn := fmt.Sprintf("arn:aws:iam::%s:oidc-provider/%s", accountID, host)
+
+	_, err := iamClient.GetOpenIDConnectProvider(&iam.GetOpenIDConnectProviderInput{
+		OpenIDConnectProviderArn: aws.String(arn),
+	})
+	if err == nil {
+		logrus.WithField("issuer", issuer).Debug("IAM OIDC provider already exists")
+		return arn, nil
+	}
+	if awsErr, ok := err.(interface{ Code() string }); !ok || awsErr.Code() != iam.ErrCodeNoSuchEntityException {
+		return "", errors.Wrapf(err, "failed to look up OIDC provider for %q", issuer)
+	}
+
+	if dryRun {
+		logrus.WithField("issuer", issuer).Info("dry-run: would create IAM OIDC provider")
+		return arn, nil
+	}
+
+	thumbprint, err := rootCAThumbprint(host)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := iamClient.CreateOpenIDConnectProvider(&iam.CreateOpenIDConnectProviderInput{
+		Url:            aws.String(issuer),
+		ClientIDList:   aws.StringSlice([]string{STSAudience}),
+		ThumbprintList: aws.StringSlice([]string{thumbprint}),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create OIDC provider for %q", issuer)
+	}
+
+	logrus.WithField("issuer", issuer).Info("created IAM OIDC provider")
+	return *out.OpenIDConnectProviderArn, nil
+}
+
+// rootCAThumbprint fetches the TLS certificate chain presented by host:443
+// and returns the SHA-1 fingerprint of the root CA certificate, in the hex
+// form IAM's CreateOpenIDConnectProvider expects.
+func rootCAThumbprint(host string) (string, error) {
+	conn, err := tls.Dial("tcp", host+":443", &tls.Config{MinVersion: tls.VersionTLS12})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch TLS certificate chain for %q", host)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.Errorf("no TLS certificates presented by %q", host)
+	}
+
+	root := certs[len(certs)-1]
+	sum := sha1.Sum(root.Raw) //nolint:gosec
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// trustPolicyDocument builds the assume-role policy a ServiceAccount's
+// federated OIDC identity must satisfy: Federated principal pointing at the
+// OIDC provider, sts:AssumeRoleWithWebIdentity, and a StringEquals condition
+// pinning both the audience and the "<issuer>:sub" claim to
+// "system:serviceaccount:<namespace>:<name>".
+func trustPolicyDocument(providerARN, issuer, namespace, serviceAccount string) (string, error) {
+	issuerURL, err := url.Parse(issuer)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid OIDC issuer URL %q", issuer)
+	}
+	issuerHostPath := issuerURL.Host + issuerURL.Path
+
+	doc := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect": "Allow",
+				"Principal": map[string]string{
+					"Federated": providerARN,
+				},
+				"Action": "sts:AssumeRoleWithWebIdentity",
+				"Condition": map[string]interface{}{
+					"StringEquals": map[string]string{
+						issuerHostPath + ":sub": fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccount),
+						issuerHostPath + ":aud": STSAudience,
+					},
+				},
+			},
+		},
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal trust policy document")
+	}
+	return string(raw), nil
+}
+
+// createOrUpdateRole creates roleName with trustPolicy, or reconciles its
+// assume-role policy in place if the role already exists: the live document
+// is only overwritten when it differs from the desired one, so a re-run of
+// the pipeline (e.g. on CI retry) is a no-op. When dryRun is set, the role
+// is only ever read (via GetRole), never created or updated.
+func createOrUpdateRole(iamClient *iam.IAM, accountID, roleName, trustPolicy string, dryRun bool) (string, error) {
+	if dryRun {
+		getOut, err := iamClient.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
+		if err != nil {
+			awsErr, ok := err.(interface{ Code() string })
+			if !ok || awsErr.Code() != iam.ErrCodeNoSuchEntityException {
+				return "", errors.Wrapf(err, "failed to get existing role %q", roleName)
+			}
+			logrus.WithField("role", roleName).Info("dry-run: would create role")
+			return fmt.Sprintf("arn:aws:iam::%s:role/%s", accountID, roleName), nil
+		}
+
+		live, err := decodePolicyDocument(aws.StringValue(getOut.Role.AssumeRolePolicyDocument))
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to decode live trust policy for role %q", roleName)
+		}
+
+		if live == trustPolicy {
+			logrus.WithField("role", roleName).Debug("trust policy already up to date")
+			return *getOut.Role.Arn, nil
+		}
+
+		logrus.WithField("role", roleName).Infof("dry-run: would update trust policy\n--- live\n%s\n--- desired\n%s", live, trustPolicy)
+		return *getOut.Role.Arn, nil
+	}
+
+	createOut, err := iamClient.CreateRole(&iam.CreateRoleInput{
+		RoleName:                 aws.String(roleName),
+		AssumeRolePolicyDocument: aws.String(trustPolicy),
+	})
+	if err == nil {
+		return *createOut.Role.Arn, nil
+	}
+
+	awsErr, ok := err.(interface{ Code() string })
+	if !ok || awsErr.Code() != iam.ErrCodeEntityAlreadyExistsException {
+		return "", errors.Wrapf(err, "failed to create role %q", roleName)
+	}
+
+	getOut, err := iamClient.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get existing role %q", roleName)
+	}
+
+	live, err := decodePolicyDocument(aws.StringValue(getOut.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decode live trust policy for role %q", roleName)
+	}
+
+	if live == trustPolicy {
+		logrus.WithField("role", roleName).Debug("trust policy already up to date")
+		return *getOut.Role.Arn, nil
+	}
+
+	if _, err := iamClient.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{
+		RoleName:       aws.String(roleName),
+		PolicyDocument: aws.String(trustPolicy),
+	}); err != nil {
+		return "", errors.Wrapf(err, "failed to update trust policy for role %q", roleName)
+	}
+	logrus.WithField("role", roleName).Info("updated trust policy")
+
+	return *getOut.Role.Arn, nil
+}
+
+// decodePolicyDocument URL-decodes the policy document IAM returns (it
+// percent-encodes the JSON it stores) so it can be compared byte-for-byte
+// against a freshly marshalled desired document.
+func decodePolicyDocument(encoded string) (string, error) {
+	return url.QueryUnescape(encoded)
+}
+
+// ensureServiceAccount creates the ServiceAccount in namespace and annotates
+// it with roleARN, or patches the annotation onto it if it already exists
+// and the annotation differs. When dryRun is set, a needed patch is logged
+// but never applied.
+func ensureServiceAccount(kubeClient kubernetes.Interface, namespace, name, roleARN string, dryRun bool) error {
+	ctx := context.Background()
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: map[string]string{ServiceAccountAnnotation: roleARN},
+		},
+	}
+
+	if dryRun {
+		existing, err := kubeClient.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			logrus.WithField("serviceaccount", name).Info("dry-run: would create service account")
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to get existing service account")
+		}
+		if existing.Annotations[ServiceAccountAnnotation] != roleARN {
+			logrus.WithField("serviceaccount", name).Infof("dry-run: would set annotation %s=%s", ServiceAccountAnnotation, roleARN)
+		}
+		return nil
+	}
+
+	_, err := kubeClient.CoreV1().ServiceAccounts(namespace).Create(ctx, sa, metav1.CreateOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return errors.Wrap(err, "failed to create service account")
+	}
+
+	existing, err := kubeClient.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to get existing service account")
+	}
+	if existing.Annotations[ServiceAccountAnnotation] == roleARN {
+		return nil
+	}
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	existing.Annotations[ServiceAccountAnnotation] = roleARN
+	if _, err := kubeClient.CoreV1().ServiceAccounts(namespace).Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return errors.Wrap(err, "failed to annotate existing service account")
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package irsa
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTrustPolicyDocument(t *testing.T) {
+	tests := []struct {
+		name           string
+		providerARN    string
+		issuer         string
+		namespace      string
+		serviceAccount string
+		wantSub        string
+		wantAud        string
+		wantErr        bool
+	}{
+		{
+			name:           "typical EKS issuer",
+			providerARN:    "arn:aws:iam::123456789012:oidc-provider/oidc.eks.eu-west-1.amazonaws.com/id/EXAMPLED539D4633E53DE1B716D3041E",
+			issuer:         "https://oidc.eks.eu-west-1.amazonaws.com/id/EXAMPLED539D4633E53DE1B716D3041E",
+			namespace:      "gitlab-runner",
+			serviceAccount: "gitlab-runner",
+			wantSub:        "system:serviceaccount:gitlab-runner:gitlab-runner",
+			wantAud:        STSAudience,
+		},
+		{
+			name:           "issuer with a path",
+			providerARN:    "arn:aws:iam::123456789012:oidc-provider/example.com/cluster-a",
+			issuer:         "https://example.com/cluster-a",
+			namespace:      "ns",
+			serviceAccount: "sa",
+			wantSub:        "system:serviceaccount:ns:sa",
+			wantAud:        STSAudience,
+		},
+		{
+			name:        "invalid issuer URL",
+			providerARN: "arn:aws:iam::123456789012:oidc-provider/bad",
+			issuer:      "://not-a-url",
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := trustPolicyDocument(tt.providerARN, tt.issuer, tt.namespace, tt.serviceAccount)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var doc struct {
+				Version   string `json:"Version"`
+				Statement []struct {
+					Effect    string `json:"Effect"`
+					Principal struct {
+						Federated string `json:"Federated"`
+					} `json:"Principal"`
+					Action    string `json:"Action"`
+					Condition struct {
+						StringEquals map[string]string `json:"StringEquals"`
+					} `json:"Condition"`
+				} `json:"Statement"`
+			}
+			if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+				t.Fatalf("trust policy is not valid JSON: %v", err)
+			}
+
+			if doc.Version != "2012-10-17" {
+				t.Errorf("Version = %q, want 2012-10-17", doc.Version)
+			}
+			if len(doc.Statement) != 1 {
+				t.Fatalf("got %d statements, want 1", len(doc.Statement))
+			}
+			stmt := doc.Statement[0]
+			if stmt.Effect != "Allow" {
+				t.Errorf("Effect = %q, want Allow", stmt.Effect)
+			}
+			if stmt.Principal.Federated != tt.providerARN {
+				t.Errorf("Principal.Federated = %q, want %q", stmt.Principal.Federated, tt.providerARN)
+			}
+			if stmt.Action != "sts:AssumeRoleWithWebIdentity" {
+				t.Errorf("Action = %q, want sts:AssumeRoleWithWebIdentity", stmt.Action)
+			}
+
+			var subKey, audKey string
+			for k := range stmt.Condition.StringEquals {
+				switch {
+				case len(k) >= 4 && k[len(k)-4:] == ":sub":
+					subKey = k
+				case len(k) >= 4 && k[len(k)-4:] == ":aud":
+					audKey = k
+				}
+			}
+			if got := stmt.Condition.StringEquals[subKey]; got != tt.wantSub {
+				t.Errorf(":sub condition = %q, want %q", got, tt.wantSub)
+			}
+			if got := stmt.Condition.StringEquals[audKey]; got != tt.wantAud {
+				t.Errorf(":aud condition = %q, want %q", got, tt.wantAud)
+			}
+		})
+	}
+}
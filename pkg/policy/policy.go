@@ -0,0 +1,243 @@
+// Package policy generates a principle-of-least-privilege IAM policy
+// document for GitLabRunnerRole from declarative inputs (cache bucket
+// ARNs, EC2 instance types/AZs the autoscaler may use, the exact
+// iam:PassRole target, KMS key ARNs, and ECR repositories), instead of
+// the "ec2:*"/"s3:*"/iam:PassRole-on-"*" policy baked into main.go. A
+// preset, named after a runner executor, seeds the EC2 actions that
+// executor needs. The preset is taken from --policy-preset or the inputs
+// file; it is not read from values.yaml's runners.executor.
+package policy
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Preset seeds a starting set of actions for the runner executor it is
+// named after (the executor set under runners.executor in the Helm values).
+type Preset string
+
+const (
+	// PresetMinimal grants only the cache/PassRole/ECR statements every
+	// executor needs; it seeds no EC2 instance lifecycle actions.
+	PresetMinimal Preset = "minimal"
+	// PresetDockerMachine seeds the EC2 instance lifecycle actions the
+	// docker+machine executor's autoscaler needs to create and tear down
+	// build-host instances.
+	PresetDockerMachine Preset = "docker-machine"
+	// PresetKubernetesExecutor seeds nothing beyond the minimal set: the
+	// kubernetes executor schedules build pods on the cluster itself
+	// rather than provisioning EC2 instances.
+	PresetKubernetesExecutor Preset = "kubernetes-executor"
+)
+
+// Inputs are the declarative, account-specific values a policy is built
+// from, normally loaded from a runner-policy.yaml file sitting alongside
+// values.yaml via LoadInputs. A zero-valued slice simply omits the
+// matching statement instead of erroring.
+type Inputs struct {
+	Preset Preset `yaml:"preset"`
+
+	// CacheBucketARNs scopes the cache statement's s3:GetObject/PutObject/
+	// DeleteObject/ListBucket actions to the runner's cache bucket(s)
+	// instead of "*".
+	CacheBucketARNs []string `yaml:"cacheBucketArns"`
+	// KMSKeyARNs scopes kms:Decrypt/kms:GenerateDataKey to the keys
+	// encrypting those buckets, for caches with SSE-KMS enabled.
+	KMSKeyARNs []string `yaml:"kmsKeyArns"`
+	// PassRoleARN is the single instance-profile role the docker+machine
+	// executor is allowed to pass to EC2, instead of iam:PassRole on "*".
+	PassRoleARN string `yaml:"passRoleArn"`
+	// EC2InstanceTypes restricts RunInstances to these instance types via
+	// an ec2:InstanceType condition.
+	EC2InstanceTypes []string `yaml:"ec2InstanceTypes"`
+	// AvailabilityZones restricts RunInstances to these AZs via an
+	// ec2:AvailabilityZone condition.
+	AvailabilityZones []string `yaml:"availabilityZones"`
+	// ECRRepositoryARNs scopes image-pull actions to the repositories the
+	// runner is allowed to pull build images from.
+	ECRRepositoryARNs []string `yaml:"ecrRepositoryArns"`
+}
+
+// LoadInputs reads and parses a runner-policy.yaml-shaped file. preset
+// overrides whatever preset the file declares when non-empty, so
+// --policy-preset always wins over the file's own default.
+func LoadInputs(path string, preset Preset) (Inputs, error) {
+	var in Inputs
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return in, errors.Wrapf(err, "failed to read policy inputs file %q", path)
+	}
+	if err := yaml.Unmarshal(data, &in); err != nil {
+		return in, errors.Wrapf(err, "failed to parse policy inputs file %q", path)
+	}
+
+	if preset != "" {
+		in.Preset = preset
+	}
+	if in.Preset == "" {
+		in.Preset = PresetMinimal
+	}
+	return in, nil
+}
+
+// statement mirrors the handful of fields an IAM policy statement needs
+// here; aws-sdk-go has no exported statement type to reuse.
+type statement struct {
+	Effect    string                 `json:"Effect"`
+	Action    []string               `json:"Action"`
+	Resource  interface{}            `json:"Resource"`
+	Condition map[string]interface{} `json:"Condition,omitempty"`
+}
+
+type document struct {
+	Version   string      `json:"Version"`
+	Statement []statement `json:"Statement"`
+}
+
+// ec2LaunchActions returns the instance-launch actions seeded for preset,
+// i.e. the ones an ec2:InstanceType/ec2:AvailabilityZone condition can
+// legitimately restrict.
+func ec2LaunchActions(preset Preset) []string {
+	switch preset {
+	case PresetDockerMachine:
+		return []string{"ec2:RunInstances"}
+	default:
+		return nil
+	}
+}
+
+// ec2LifecycleActions returns the instance lifecycle/describe/tag actions
+// seeded for preset. These actions don't accept an ec2:InstanceType or
+// ec2:AvailabilityZone condition key, so they must never share a statement
+// with ec2LaunchActions: IAM evaluates a condition against a request that
+// lacks the key as non-matching, which would silently deny every one of
+// these calls once in.EC2InstanceTypes/in.AvailabilityZones is set.
+func ec2LifecycleActions(preset Preset) []string {
+	switch preset {
+	case PresetDockerMachine:
+		return []string{
+			"ec2:TerminateInstances",
+			"ec2:StartInstances",
+			"ec2:StopInstances",
+			"ec2:DescribeInstances",
+			"ec2:DescribeInstanceStatus",
+			"ec2:CreateTags",
+		}
+	default:
+		return nil
+	}
+}
+
+// Build renders in into a JSON IAM policy document scoped to exactly the
+// actions and resources in.Preset and the supplied ARNs need.
+func Build(in Inputs) (string, error) {
+	var statements []statement
+
+	if actions := ec2LaunchActions(in.Preset); len(actions) > 0 {
+		statements = append(statements, statement{
+			Effect:    "Allow",
+			Action:    actions,
+			Resource:  "*",
+			Condition: ec2Condition(in),
+		})
+	}
+
+	if actions := ec2LifecycleActions(in.Preset); len(actions) > 0 {
+		statements = append(statements, statement{
+			Effect:   "Allow",
+			Action:   actions,
+			Resource: "*",
+		})
+	}
+
+	if in.PassRoleARN != "" {
+		statements = append(statements, statement{
+			Effect:   "Allow",
+			Action:   []string{"iam:PassRole"},
+			Resource: in.PassRoleARN,
+		})
+	}
+
+	if len(in.CacheBucketARNs) > 0 {
+		statements = append(statements, statement{
+			Effect:   "Allow",
+			Action:   []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject", "s3:ListBucket"},
+			Resource: bucketResources(in.CacheBucketARNs),
+		})
+	}
+
+	if len(in.KMSKeyARNs) > 0 {
+		statements = append(statements, statement{
+			Effect:   "Allow",
+			Action:   []string{"kms:Decrypt", "kms:GenerateDataKey"},
+			Resource: toResource(in.KMSKeyARNs),
+		})
+	}
+
+	if len(in.ECRRepositoryARNs) > 0 {
+		statements = append(statements,
+			statement{
+				Effect:   "Allow",
+				Action:   []string{"ecr:GetDownloadUrlForLayer", "ecr:BatchGetImage", "ecr:BatchCheckLayerAvailability"},
+				Resource: toResource(in.ECRRepositoryARNs),
+			},
+			statement{
+				Effect:   "Allow",
+				Action:   []string{"ecr:GetAuthorizationToken"},
+				Resource: "*",
+			},
+		)
+	}
+
+	if len(statements) == 0 {
+		return "", errors.New("policy inputs produced no statements; set at least one of cacheBucketArns/passRoleArn/kmsKeyArns/ecrRepositoryArns, or a preset with seeded actions")
+	}
+
+	out, err := json.MarshalIndent(document{Version: "2012-10-17", Statement: statements}, "", "\t")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal policy document")
+	}
+	return string(out), nil
+}
+
+// ec2Condition builds the StringEquals condition restricting RunInstances
+// to in.EC2InstanceTypes/in.AvailabilityZones, or nil if neither is set.
+func ec2Condition(in Inputs) map[string]interface{} {
+	stringEquals := map[string]interface{}{}
+	if len(in.EC2InstanceTypes) > 0 {
+		stringEquals["ec2:InstanceType"] = in.EC2InstanceTypes
+	}
+	if len(in.AvailabilityZones) > 0 {
+		stringEquals["ec2:AvailabilityZone"] = in.AvailabilityZones
+	}
+	if len(stringEquals) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"StringEquals": stringEquals}
+}
+
+// bucketResources expands each bucket ARN to also cover its objects
+// (arn:...:bucket/*), since s3:GetObject/PutObject/DeleteObject only
+// apply to object ARNs while s3:ListBucket applies to the bucket ARN.
+func bucketResources(bucketARNs []string) []string {
+	resources := make([]string, 0, len(bucketARNs)*2)
+	for _, arn := range bucketARNs {
+		resources = append(resources, arn, arn+"/*")
+	}
+	return resources
+}
+
+// toResource collapses a single-element slice to a bare string, since IAM
+// accepts either a string or a list for Resource and a bare string reads
+// better in the rendered document.
+func toResource(arns []string) interface{} {
+	if len(arns) == 1 {
+		return arns[0]
+	}
+	return arns
+}
@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      Inputs
+		wantErr bool
+		check   func(t *testing.T, doc document)
+	}{
+		{
+			name:    "no inputs produces no statements",
+			in:      Inputs{Preset: PresetMinimal},
+			wantErr: true,
+		},
+		{
+			name: "docker-machine preset splits launch from lifecycle actions",
+			in: Inputs{
+				Preset:            PresetDockerMachine,
+				EC2InstanceTypes:  []string{"m5.large"},
+				AvailabilityZones: []string{"eu-west-1a"},
+				CacheBucketARNs:   []string{"arn:aws:s3:::runner-cache"},
+			},
+			check: func(t *testing.T, doc document) {
+				launch := findStatement(t, doc, "ec2:RunInstances")
+				if launch.Condition == nil {
+					t.Fatal("launch statement has no Condition, want ec2:InstanceType/ec2:AvailabilityZone StringEquals")
+				}
+				for _, action := range launch.Action {
+					if action != "ec2:RunInstances" {
+						t.Errorf("launch statement has extra action %q sharing a condition it shouldn't", action)
+					}
+				}
+
+				lifecycle := findStatement(t, doc, "ec2:TerminateInstances")
+				if lifecycle.Condition != nil {
+					t.Errorf("lifecycle statement has a Condition %v, want none (condition keys aren't present for these actions)", lifecycle.Condition)
+				}
+				wantLifecycle := map[string]bool{
+					"ec2:TerminateInstances":     true,
+					"ec2:StartInstances":         true,
+					"ec2:StopInstances":          true,
+					"ec2:DescribeInstances":      true,
+					"ec2:DescribeInstanceStatus": true,
+					"ec2:CreateTags":             true,
+				}
+				for _, action := range lifecycle.Action {
+					if !wantLifecycle[action] {
+						t.Errorf("unexpected action %q in lifecycle statement", action)
+					}
+					delete(wantLifecycle, action)
+				}
+				if len(wantLifecycle) != 0 {
+					t.Errorf("lifecycle statement missing actions: %v", wantLifecycle)
+				}
+			},
+		},
+		{
+			name: "kubernetes-executor preset seeds no EC2 statements",
+			in: Inputs{
+				Preset:          PresetKubernetesExecutor,
+				CacheBucketARNs: []string{"arn:aws:s3:::runner-cache"},
+			},
+			check: func(t *testing.T, doc document) {
+				for _, stmt := range doc.Statement {
+					for _, action := range stmt.Action {
+						if len(action) >= 4 && action[:4] == "ec2:" {
+							t.Errorf("kubernetes-executor preset produced an EC2 action %q, want none", action)
+						}
+					}
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := Build(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var doc document
+			if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+				t.Fatalf("Build output is not valid JSON: %v", err)
+			}
+			if doc.Version != "2012-10-17" {
+				t.Errorf("Version = %q, want 2012-10-17", doc.Version)
+			}
+			tt.check(t, doc)
+		})
+	}
+}
+
+// findStatement returns the first statement in doc whose Action list
+// contains wantAction, failing the test if none does.
+func findStatement(t *testing.T, doc document, wantAction string) statement {
+	t.Helper()
+	for _, stmt := range doc.Statement {
+		for _, action := range stmt.Action {
+			if action == wantAction {
+				return stmt
+			}
+		}
+	}
+	t.Fatalf("no statement found with action %q", wantAction)
+	return statement{}
+}
+
+func TestEC2ConditionOmittedWhenUnset(t *testing.T) {
+	if got := ec2Condition(Inputs{}); got != nil {
+		t.Errorf("ec2Condition(Inputs{}) = %v, want nil", got)
+	}
+}
+
+func TestBucketResources(t *testing.T) {
+	got := bucketResources([]string{"arn:aws:s3:::a", "arn:aws:s3:::b"})
+	want := []string{"arn:aws:s3:::a", "arn:aws:s3:::a/*", "arn:aws:s3:::b", "arn:aws:s3:::b/*"}
+	if len(got) != len(want) {
+		t.Fatalf("bucketResources returned %d entries, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("bucketResources()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestToResource(t *testing.T) {
+	if got := toResource([]string{"arn:aws:kms:::key/1"}); got != "arn:aws:kms:::key/1" {
+		t.Errorf("toResource single-element = %v, want bare string", got)
+	}
+
+	arns := []string{"arn:aws:kms:::key/1", "arn:aws:kms:::key/2"}
+	got, ok := toResource(arns).([]string)
+	if !ok || len(got) != 2 {
+		t.Errorf("toResource multi-element = %v, want the original slice", got)
+	}
+}
@@ -0,0 +1,207 @@
+// Package rollout waits for a Helm-installed Deployment to actually
+// finish rolling out, instead of the deploy binary reporting success as
+// soon as `helm install`/`helm upgrade` returns (which only means the
+// objects were accepted by the API server, not that the Deployment's
+// pods became Ready). It also streams the release's Pods/Events to
+// stdout while waiting, and can dump recent Events/Pod logs for
+// diagnostics when a rollout times out.
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Config controls which Deployment/Pods/Events Wait and DumpDiagnostics
+// watch and how long a rollout is given to finish.
+type Config struct {
+	Namespace      string
+	ReleaseName    string
+	DeploymentName string
+
+	// Timeout bounds how long Wait polls the Deployment's status before
+	// declaring the rollout failed. Zero means DefaultTimeout.
+	Timeout time.Duration
+	// EventTailLines bounds how many recent Events DumpDiagnostics prints.
+	// Zero means DefaultEventTailLines.
+	EventTailLines int
+	// PodLogTailLines bounds how many recent log lines DumpDiagnostics
+	// prints per pod. Zero means DefaultPodLogTailLines.
+	PodLogTailLines int64
+}
+
+const (
+	// DefaultTimeout is used when Config.Timeout is zero.
+	DefaultTimeout = 5 * time.Minute
+	// DefaultEventTailLines is used when Config.EventTailLines is zero.
+	DefaultEventTailLines = 20
+	// DefaultPodLogTailLines is used when Config.PodLogTailLines is zero.
+	DefaultPodLogTailLines = 200
+
+	pollInterval = 2 * time.Second
+)
+
+// releaseSelector is the label selector Helm stamps on every object it
+// installs, restricting Pod/Event streaming to the release being deployed.
+func releaseSelector(releaseName string) string {
+	return fmt.Sprintf("app.kubernetes.io/instance=%s", releaseName)
+}
+
+// Wait blocks until cfg.DeploymentName's status reports
+// ObservedGeneration >= Generation and AvailableReplicas == Replicas,
+// streaming the release's Pods and Events to stdout as they change. It
+// returns an error if the rollout does not finish within cfg.Timeout.
+func Wait(ctx context.Context, client kubernetes.Interface, cfg Config) error {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	go streamEvents(ctx, client, cfg.Namespace, releaseSelector(cfg.ReleaseName))
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("rollout of deployment %q did not become ready within %s", cfg.DeploymentName, timeout)
+		case <-ticker.C:
+			dep, err := client.AppsV1().Deployments(cfg.Namespace).Get(ctx, cfg.DeploymentName, metav1.GetOptions{})
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					continue // the chart hasn't created it yet
+				}
+				return errors.Wrapf(err, "failed to get deployment %q", cfg.DeploymentName)
+			}
+			if rolloutComplete(dep) {
+				logrus.WithField("deployment", cfg.DeploymentName).Info("rollout complete")
+				return nil
+			}
+		}
+	}
+}
+
+// rolloutComplete reports whether the Deployment controller has observed
+// the latest generation and every replica it reports is available. Unlike
+// `kubectl rollout status`, it does not look at UpdatedReplicas.
+func rolloutComplete(dep *appsv1.Deployment) bool {
+	return dep.Status.ObservedGeneration >= dep.Generation &&
+		dep.Status.AvailableReplicas == dep.Status.Replicas
+}
+
+// streamEvents logs updates of the Pods matching selector, and the Events
+// whose involvedObject is one of those Pods, to stdout until ctx is done.
+// An Event is only logged once its Pod has been seen on the pod watch. Watch failures are
+// logged and swallowed: losing the live stream must never fail the
+// rollout wait itself.
+func streamEvents(ctx context.Context, client kubernetes.Interface, namespace, selector string) {
+	podWatch, err := client.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to watch pods for rollout stream")
+		return
+	}
+	defer podWatch.Stop()
+
+	eventWatch, err := client.CoreV1().Events(namespace).Watch(ctx, metav1.ListOptions{FieldSelector: "involvedObject.kind=Pod"})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to watch events for rollout stream")
+		return
+	}
+	defer eventWatch.Stop()
+
+	releasePods := map[string]bool{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-podWatch.ResultChan():
+			if !ok {
+				return
+			}
+			if pod, ok := ev.Object.(*corev1.Pod); ok {
+				releasePods[pod.Name] = true
+				logrus.WithFields(logrus.Fields{"pod": pod.Name, "phase": pod.Status.Phase}).Info("pod update")
+			}
+		case ev, ok := <-eventWatch.ResultChan():
+			if !ok {
+				return
+			}
+			if kubeEvent, ok := ev.Object.(*corev1.Event); ok && releasePods[kubeEvent.InvolvedObject.Name] {
+				logrus.WithFields(logrus.Fields{"object": kubeEvent.InvolvedObject.Name, "reason": kubeEvent.Reason}).Info(kubeEvent.Message)
+			}
+		}
+	}
+}
+
+// DumpDiagnostics prints the last cfg.EventTailLines Pod Events and the
+// last cfg.PodLogTailLines log lines of every release Pod to stdout, so a
+// failed or timed-out rollout leaves enough context in the CI job log to
+// debug without re-running kubectl by hand.
+func DumpDiagnostics(ctx context.Context, client kubernetes.Interface, cfg Config) {
+	eventTail := cfg.EventTailLines
+	if eventTail == 0 {
+		eventTail = DefaultEventTailLines
+	}
+	logTail := cfg.PodLogTailLines
+	if logTail == 0 {
+		logTail = DefaultPodLogTailLines
+	}
+
+	dumpRecentEvents(ctx, client, cfg.Namespace, eventTail)
+	dumpPodLogs(ctx, client, cfg.Namespace, releaseSelector(cfg.ReleaseName), logTail)
+}
+
+func dumpRecentEvents(ctx context.Context, client kubernetes.Interface, namespace string, tail int) {
+	events, err := client.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{FieldSelector: "involvedObject.kind=Pod"})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to list events for diagnostics")
+		return
+	}
+
+	items := events.Items
+	if len(items) > tail {
+		items = items[len(items)-tail:]
+	}
+	for _, e := range items {
+		logrus.WithFields(logrus.Fields{"object": e.InvolvedObject.Name, "reason": e.Reason}).Warn(e.Message)
+	}
+}
+
+func dumpPodLogs(ctx context.Context, client kubernetes.Interface, namespace, selector string, tailLines int64) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to list pods for diagnostics")
+		return
+	}
+
+	for _, pod := range pods.Items {
+		req := client.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{TailLines: &tailLines})
+		stream, err := req.Stream(ctx)
+		if err != nil {
+			logrus.WithError(err).Warnf("failed to get logs for pod %q", pod.Name)
+			continue
+		}
+
+		fmt.Fprintf(os.Stdout, "--- logs: %s ---\n", pod.Name)
+		if _, err := io.Copy(os.Stdout, stream); err != nil {
+			logrus.WithError(err).Warnf("failed to stream logs for pod %q", pod.Name)
+		}
+		stream.Close()
+	}
+}